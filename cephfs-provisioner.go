@@ -1,13 +1,21 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/ceph/cephfs/pkg/gidallocator"
+	"github.com/kubernetes-incubator/external-storage/ceph/cephfs/pkg/metrics"
 	"github.com/kubernetes-incubator/nfs-provisioner/controller"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/pkg/api/v1"
@@ -15,6 +23,9 @@ import (
 	"k8s.io/client-go/pkg/util/uuid"
 	"k8s.io/client-go/pkg/util/wait"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
@@ -22,48 +33,477 @@ const (
 	provisionerName           = "kubernetes.io/cephfs"
 	exponentialBackOffOnError = false
 	failedRetryThreshold      = 5
+
+	// cephFSProvisionerCLI is the Python helper that talks to the Ceph
+	// cluster on our behalf. It wraps ceph-authtool and the mgr/volumes
+	// (or legacy tree) commands needed to create/destroy a subvolume and
+	// its scoped cephx user.
+	cephFSProvisionerCLI = "/usr/local/bin/cephfs_provisioner"
+
+	secretKeyName = "key"
+
+	defaultMetadataConfigMapName = "cephfs-provisioner-metadata"
+
+	provisionerIDAnn = "cephFSProvisionerIdentity"
+	// quotaAnn records the quota size (in bytes) the provisioner actually
+	// managed to enforce on the subvolume, or "0" if enforcing it failed
+	// (for any reason), in which case the PV's capacity is advisory only.
+	quotaAnn = "cephFSProvisionerQuotaBytes"
+	// gidAnn is the standard annotation consumed by kubelet to chown a
+	// volume's mount point to the allocated GID before a pod can use it.
+	gidAnn = "pv.beta.kubernetes.io/gid"
+
+	cephAdminMountPoint = "/tmp/cephfs_provisioner_admin_mount"
+
+	defaultGidMin = 2000
+	defaultGidMax = 2147483647
 )
 
+// cephFSProvisioner implements controller.Provisioner by delegating the
+// actual Ceph-side work to cephFSProvisionerCLI.
 type cephFSProvisioner struct {
-	// Required: Monitors is a collection of Ceph monitors
-	Monitors []string `json:"monitors"`
-	// Optional: User is the rados user name, default is admin
-	Admin string `json:"admin,omitempty"`
-	// Required: Secret is Admin's secret.
-	Secret string `json:"secret,omitempty"`
-
-	// Identity of this cephFSProvisioner, generated. Used to identify "this"
-	// provisioner's PVs.
+	client    kubernetes.Interface
+	store     MetadataStore
+	allocator *gidallocator.Allocator
+	// namespace holds the cluster-scoped bookkeeping ConfigMaps (metadata,
+	// GID ranges) that don't belong to any one PVC's namespace.
+	namespace string
+
+	// Identity of this cephFSProvisioner. Persisted in store so that it
+	// survives process restarts: without that, a restarted provisioner
+	// would mint a fresh identity, stop matching the provisionerIDAnn
+	// annotation on the PVs it previously created, and leak their
+	// subvolumes in Ceph forever on Delete.
 	identity types.UID
 }
 
-func NewCephFSProvisioner() controller.Provisioner {
-	return &cephFSProvisioner{
-		identity: uuid.NewUUID(),
+func NewCephFSProvisioner(client kubernetes.Interface, store MetadataStore, namespace string) (controller.Provisioner, error) {
+	identity, err := store.Identity()
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish provisioner identity: %v", err)
 	}
+	return &cephFSProvisioner{
+		client:    client,
+		store:     store,
+		allocator: gidallocator.New(client),
+		namespace: namespace,
+		identity:  identity,
+	}, nil
 }
 
 var _ controller.Provisioner = &cephFSProvisioner{}
 
+// provisionOutput is the JSON document cephFSProvisionerCLI prints on stdout
+// after successfully creating a subvolume and cephx user.
+type provisionOutput struct {
+	Path   string `json:"path"`
+	User   string `json:"user"`
+	Secret string `json:"auth_key"`
+	// QuotaBytes is set by cephFSProvisionerCLI when it created the
+	// subvolume through the mgr/volumes plugin with --size and the quota
+	// was applied server-side. It is 0 when the cluster predates
+	// mgr/volumes and the quota still needs to be set by hand.
+	QuotaBytes int64 `json:"quota_bytes"`
+}
+
+// cephFSParameters holds the StorageClass parameters this provisioner
+// understands.
+type cephFSParameters struct {
+	monitors             []string
+	adminID              string
+	adminSecretName      string
+	adminSecretNamespace string
+	claimRoot            string
+	deterministicNames   bool
+	gidAllocate          bool
+	gidMin               int
+	gidMax               int
+}
+
+func (p *cephFSProvisioner) parseParameters(parameters map[string]string) (*cephFSParameters, error) {
+	params := &cephFSParameters{
+		adminID:              "admin",
+		adminSecretNamespace: "default",
+		claimRoot:            "/volumes",
+		gidMin:               defaultGidMin,
+		gidMax:               defaultGidMax,
+	}
+
+	for k, v := range parameters {
+		switch strings.ToLower(k) {
+		case "monitors":
+			params.monitors = strings.Split(v, ",")
+		case "adminid":
+			params.adminID = v
+		case "adminsecretname":
+			params.adminSecretName = v
+		case "adminsecretnamespace":
+			params.adminSecretNamespace = v
+		case "claimroot":
+			params.claimRoot = v
+		case "deterministicnames":
+			deterministic, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q for parameter %q: %v", v, k, err)
+			}
+			params.deterministicNames = deterministic
+		case "gidallocate":
+			allocate, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q for parameter %q: %v", v, k, err)
+			}
+			params.gidAllocate = allocate
+		case "gidmin":
+			gidMin, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q for parameter %q: %v", v, k, err)
+			}
+			params.gidMin = gidMin
+		case "gidmax":
+			gidMax, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q for parameter %q: %v", v, k, err)
+			}
+			params.gidMax = gidMax
+		default:
+			return nil, fmt.Errorf("invalid parameter %q", k)
+		}
+	}
+
+	if len(params.monitors) == 0 {
+		return nil, errors.New("missing Ceph monitors, set the \"monitors\" StorageClass parameter")
+	}
+	if params.adminSecretName == "" {
+		return nil, errors.New("missing Ceph admin secret name, set the \"adminSecretName\" StorageClass parameter")
+	}
+	if params.gidAllocate && params.gidMin > params.gidMax {
+		return nil, fmt.Errorf("invalid GID range: gidMin %d is greater than gidMax %d", params.gidMin, params.gidMax)
+	}
+
+	return params, nil
+}
+
+// adminSecret returns the cephx key of the admin (or admin-equivalent) user
+// used to authenticate the helper against the cluster.
+func (p *cephFSProvisioner) adminSecret(params *cephFSParameters) (string, error) {
+	secret, err := p.client.Core().Secrets(params.adminSecretNamespace).Get(params.adminSecretName)
+	if err != nil {
+		return "", fmt.Errorf("failed to get admin secret %s/%s: %v", params.adminSecretNamespace, params.adminSecretName, err)
+	}
+	key, ok := secret.Data[secretKeyName]
+	if !ok {
+		return "", fmt.Errorf("admin secret %s/%s has no %q key", params.adminSecretNamespace, params.adminSecretName, secretKeyName)
+	}
+	return string(key), nil
+}
+
+// volumeName derives the name the subvolume will be created under in Ceph.
+// Deterministic names let the same PVC always map to the same subvolume
+// name. Delete does not recompute the name; it removes the volume recorded
+// for the PV in the MetadataStore.
+func volumeName(pvName string, deterministic bool) string {
+	if deterministic {
+		return pvName
+	}
+	return fmt.Sprintf("%s-%s", pvName, string(uuid.NewUUID())[0:8])
+}
+
+// createVolume shells out to cephFSProvisionerCLI to create a subvolume
+// rooted at params.claimRoot and a cephx user scoped to it, sized to
+// sizeBytes. On clusters with the mgr/volumes plugin (Nautilus+) the CLI
+// applies the quota itself as part of subvolume creation; on older
+// clusters the returned quota is 0 and the caller must fall back to
+// setQuotaFallback.
+func (p *cephFSProvisioner) createVolume(volID string, params *cephFSParameters, adminSecret string, sizeBytes int64) (*provisionOutput, error) {
+	args := []string{
+		"-n", volID,
+		"-u", volID,
+		"--claim-root", params.claimRoot,
+		"-m", strings.Join(params.monitors, ","),
+		"-c", "ceph",
+		"--id", params.adminID,
+		"--key", adminSecret,
+		"--size", strconv.FormatInt(sizeBytes, 10),
+	}
+
+	cmd := exec.Command(cephFSProvisionerCLI, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %v, output: %s", cephFSProvisionerCLI, err, out)
+	}
+
+	res := &provisionOutput{}
+	if err := json.Unmarshal(out, res); err != nil {
+		return nil, fmt.Errorf("failed to parse %s output %q: %v", cephFSProvisionerCLI, out, err)
+	}
+	if res.Path == "" || res.User == "" || res.Secret == "" {
+		return nil, fmt.Errorf("%s returned incomplete result: %+v", cephFSProvisionerCLI, res)
+	}
+	return res, nil
+}
+
+// withAdminMount briefly mounts the cephfs root as the cluster admin and
+// calls fn with the local path of subvolumePath under that mount, cleaning
+// the mount up again afterwards. It backs both the quota and GID-ownership
+// fallbacks, which both need filesystem-level access the kernel client
+// doesn't expose any other way.
+func (p *cephFSProvisioner) withAdminMount(subvolumePath string, params *cephFSParameters, adminSecret string, fn func(fullPath string) error) error {
+	if err := os.MkdirAll(cephAdminMountPoint, 0755); err != nil {
+		return fmt.Errorf("failed to create admin mount point: %v", err)
+	}
+
+	mountDir, err := ioutil.TempDir(cephAdminMountPoint, "mount-")
+	if err != nil {
+		return fmt.Errorf("failed to create admin mount dir: %v", err)
+	}
+	defer os.RemoveAll(mountDir)
+
+	mountSource := fmt.Sprintf("%s:/", strings.Join(params.monitors, ","))
+	mountArgs := []string{"-t", "ceph", mountSource, mountDir, "-o", fmt.Sprintf("name=%s,secret=%s", params.adminID, adminSecret)}
+	if out, err := exec.Command("mount", mountArgs...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to mount cephfs root: %v, output: %s", err, out)
+	}
+	defer func() {
+		if out, err := exec.Command("umount", mountDir).CombinedOutput(); err != nil {
+			glog.Errorf("failed to unmount admin mount %s: %v, output: %s", mountDir, err, out)
+		}
+	}()
+
+	return fn(path.Join(mountDir, subvolumePath))
+}
+
+// setQuotaFallback enforces sizeBytes on subvolumePath by briefly mounting
+// the filesystem as the cluster admin and setting the ceph.quota.max_bytes
+// xattr directly. It is only needed on clusters old enough to lack the
+// mgr/volumes plugin, where cephFSProvisionerCLI has no --size support of
+// its own.
+func (p *cephFSProvisioner) setQuotaFallback(subvolumePath string, params *cephFSParameters, adminSecret string, sizeBytes int64) error {
+	return p.withAdminMount(subvolumePath, params, adminSecret, func(fullPath string) error {
+		setfattrArgs := []string{"-n", "ceph.quota.max_bytes", "-v", strconv.FormatInt(sizeBytes, 10), fullPath}
+		if out, err := exec.Command("setfattr", setfattrArgs...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to set quota xattr on %s: %v, output: %s", fullPath, err, out)
+		}
+		return nil
+	})
+}
+
+// chownSubvolume chowns subvolumePath to root:gid and sets the setgid bit
+// on it, so that files newly created under the volume inherit gid
+// regardless of the UID of the process that created them.
+func (p *cephFSProvisioner) chownSubvolume(subvolumePath string, params *cephFSParameters, adminSecret string, gid int) error {
+	return p.withAdminMount(subvolumePath, params, adminSecret, func(fullPath string) error {
+		if out, err := exec.Command("chown", fmt.Sprintf("0:%d", gid), fullPath).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to chown %s to gid %d: %v, output: %s", fullPath, gid, err, out)
+		}
+		if out, err := exec.Command("chmod", "g+s", fullPath).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to set setgid bit on %s: %v, output: %s", fullPath, err, out)
+		}
+		return nil
+	})
+}
+
+// deleteVolume shells out to cephFSProvisionerCLI to revoke the cephx user
+// and remove the subvolume created for volID.
+func (p *cephFSProvisioner) deleteVolume(volID string, params *cephFSParameters, adminSecret string) error {
+	args := []string{
+		"-n", volID,
+		"-u", volID,
+		"-m", strings.Join(params.monitors, ","),
+		"-c", "ceph",
+		"--id", params.adminID,
+		"--key", adminSecret,
+		"--command", "remove",
+	}
+
+	cmd := exec.Command(cephFSProvisionerCLI, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v, output: %s", cephFSProvisionerCLI, err, out)
+	}
+	return nil
+}
+
+// abandonVolume best-effort tears down a subvolume (and, if non-empty, the
+// Secret holding its cephx user's key) created earlier in a Provision call
+// that failed partway through, so a failure doesn't orphan Ceph state that
+// nothing will ever find again.
+func (p *cephFSProvisioner) abandonVolume(volID string, params *cephFSParameters, adminSecret, secretNamespace, secretName string) {
+	if err := p.deleteVolume(volID, params, adminSecret); err != nil {
+		glog.Errorf("failed to roll back subvolume %s after a failed Provision: %v", volID, err)
+	}
+	if secretName != "" {
+		if err := p.client.Core().Secrets(secretNamespace).Delete(secretName, nil); err != nil {
+			glog.Errorf("failed to roll back secret %s/%s after a failed Provision: %v", secretNamespace, secretName, err)
+		}
+	}
+}
+
+// releaseGid returns a GID allocated earlier in a Provision call that
+// failed partway through.
+func (p *cephFSProvisioner) releaseGid(params *cephFSParameters, gid int) {
+	if err := p.allocator.Release(p.namespace, params.gidMin, params.gidMax, gid); err != nil {
+		glog.Errorf("failed to release GID %d after a failed Provision: %v", gid, err)
+	}
+}
+
+// secretForUser builds the Secret object that stores a newly created
+// cephx user's key, to be referenced from the PV's CephFSVolumeSource.
+func (p *cephFSProvisioner) secretForUser(namespace, volID, key string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      volID,
+			Namespace: namespace,
+		},
+		Data: map[string][]byte{
+			secretKeyName: []byte(key),
+		},
+		Type: "kubernetes.io/cephfs",
+	}
+}
+
 // Provision creates a storage asset and returns a PV object representing it.
 func (p *cephFSProvisioner) Provision(options controller.VolumeOptions) (*v1.PersistentVolume, error) {
-	//TODO: call out cephfs-provisioner
+	metrics.ProvisionAttemptsTotal.Inc()
+	metrics.InFlightOperations.Inc()
+	defer metrics.InFlightOperations.Dec()
+	start := time.Now()
+
+	pv, err := p.provision(options)
+
+	metrics.ProvisionDurationSeconds.Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.ProvisionFailuresTotal.WithLabelValues(failureReason(err)).Inc()
+	} else {
+		metrics.ProvisionSuccessesTotal.Inc()
+	}
+	return pv, err
+}
+
+// provision does the actual work for Provision; Provision itself only
+// wraps this with metrics instrumentation.
+func (p *cephFSProvisioner) provision(options controller.VolumeOptions) (*v1.PersistentVolume, error) {
+	params, err := p.parseParameters(options.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	capacity := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	sizeBytes := capacity.Value()
+	if sizeBytes <= 0 {
+		return nil, fmt.Errorf("invalid storage request %s: must request a positive amount of storage", capacity.String())
+	}
+
+	adminSecret, err := p.adminSecret(params)
+	if err != nil {
+		return nil, err
+	}
+
+	volID := volumeName(options.PVName, params.deterministicNames)
+
+	// Allocate the GID, if requested, before touching Ceph or creating any
+	// Kubernetes objects: a GID-range-exhausted error is then cheap to
+	// abandon, with nothing yet created that Delete would need to find.
+	var gid int
+	if params.gidAllocate {
+		gid, err = p.allocator.AllocateNext(p.namespace, params.gidMin, params.gidMax)
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate a GID for volume %s: %v", volID, err)
+		}
+	}
+
+	res, err := p.createVolume(volID, params, adminSecret, sizeBytes)
+	if err != nil {
+		if params.gidAllocate {
+			p.releaseGid(params, gid)
+		}
+		return nil, err
+	}
+
+	quotaBytes := res.QuotaBytes
+	if quotaBytes == 0 {
+		if err := p.setQuotaFallback(res.Path, params, adminSecret, sizeBytes); err != nil {
+			// Not fatal to Provision: the volume is still usable, just
+			// without enforced capacity. Still worth surfacing as its own
+			// metric event since it's swallowed here rather than returned.
+			metrics.QuotaEnforcementFailuresTotal.Inc()
+			glog.Errorf("failed to enforce quota on volume %s, PV capacity will not be enforced: %v", volID, err)
+		} else {
+			quotaBytes = sizeBytes
+		}
+	}
+
+	if params.gidAllocate {
+		if err := p.chownSubvolume(res.Path, params, adminSecret, gid); err != nil {
+			p.releaseGid(params, gid)
+			p.abandonVolume(volID, params, adminSecret, "", "")
+			return nil, fmt.Errorf("failed to chown volume %s to gid %d: %v", volID, gid, err)
+		}
+	}
+
+	secretNamespace := options.PVC.Namespace
+	secret := p.secretForUser(secretNamespace, volID, res.Secret)
+	if _, err := p.client.Core().Secrets(secretNamespace).Create(secret); err != nil {
+		if params.gidAllocate {
+			p.releaseGid(params, gid)
+		}
+		p.abandonVolume(volID, params, adminSecret, "", "")
+		return nil, fmt.Errorf("failed to create secret %s/%s for volume %s: %v", secretNamespace, volID, volID, err)
+	}
+
+	md := &pvMetadata{
+		SubvolumePath:        res.Path,
+		CephUser:             res.User,
+		Pool:                 params.claimRoot,
+		SecretName:           secret.Name,
+		SecretNamespace:      secret.Namespace,
+		AdminID:              params.adminID,
+		AdminSecretName:      params.adminSecretName,
+		AdminSecretNamespace: params.adminSecretNamespace,
+	}
+
+	annotations := map[string]string{
+		provisionerIDAnn: string(p.identity),
+		quotaAnn:         strconv.FormatInt(quotaBytes, 10),
+	}
+
+	if params.gidAllocate {
+		md.Gid = gid
+		md.GidNamespace = p.namespace
+		md.GidMin = params.gidMin
+		md.GidMax = params.gidMax
+		annotations[gidAnn] = strconv.Itoa(gid)
+	}
+
+	if err := p.store.SetPV(options.PVName, md); err != nil {
+		if params.gidAllocate {
+			p.releaseGid(params, gid)
+		}
+		p.abandonVolume(volID, params, adminSecret, secret.Namespace, secret.Name)
+		return nil, fmt.Errorf("failed to persist metadata for PV %s, refusing to hand out an unrecoverable volume: %v", options.PVName, err)
+	}
+
 	pv := &v1.PersistentVolume{
 		ObjectMeta: v1.ObjectMeta{
-			Name: options.PVName,
-			Annotations: map[string]string{
-				"cephFSProvisionerIdentity": string(p.identity),
-			},
+			Name:        options.PVName,
+			Annotations: annotations,
 		},
 		Spec: v1.PersistentVolumeSpec{
 			PersistentVolumeReclaimPolicy: options.PersistentVolumeReclaimPolicy,
 			AccessModes:                   options.PVC.Spec.AccessModes,
-			Capacity: v1.ResourceList{ //FIXME: kernel cephfs doesn't enforce quota, capacity is not meaningless here.
-				v1.ResourceName(v1.ResourceStorage): options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
+			// Capacity is enforced via the ceph.quota.max_bytes xattr on the
+			// subvolume when quotaBytes > 0 (see quotaAnn); on clusters that
+			// can't enforce it this remains advisory only.
+			Capacity: v1.ResourceList{
+				v1.ResourceName(v1.ResourceStorage): capacity,
 			},
 			PersistentVolumeSource: v1.PersistentVolumeSource{
 				CephFS: &v1.CephFSVolumeSource{
-					Path: path,
+					Monitors: params.monitors,
+					Path:     res.Path,
+					User:     res.User,
+					SecretRef: &v1.LocalObjectReference{
+						Name: secret.Name,
+					},
 				},
 			},
 		},
@@ -73,24 +513,175 @@ func (p *cephFSProvisioner) Provision(options controller.VolumeOptions) (*v1.Per
 }
 
 // Delete removes the storage asset that was created by Provision represented
-// by the given PV.
+// by the given PV. What it tears down (the cephx user, the Secret, the GID
+// and the admin credentials used) comes from the per-PV record in the
+// MetadataStore, not from the PV's annotations. The PV must still carry this
+// provisioner's identity annotation, and the monitors are read from the
+// PV's CephFS volume source.
 func (p *cephFSProvisioner) Delete(volume *v1.PersistentVolume) error {
-	ann, ok := volume.Annotations["CephFSProvisionerIdentity"]
+	metrics.DeleteAttemptsTotal.Inc()
+	metrics.InFlightOperations.Inc()
+	defer metrics.InFlightOperations.Dec()
+	start := time.Now()
+
+	err := p.delete(volume)
+
+	metrics.DeleteDurationSeconds.Observe(time.Since(start).Seconds())
+	if _, ignored := err.(*controller.IgnoredError); ignored {
+		// Not ours to delete; neither a success nor a failure of this
+		// provisioner's own Delete.
+	} else if err != nil {
+		metrics.DeleteFailuresTotal.WithLabelValues(failureReason(err)).Inc()
+	} else {
+		metrics.DeleteSuccessesTotal.Inc()
+	}
+	return err
+}
+
+// delete does the actual work for Delete; Delete itself only wraps this
+// with metrics instrumentation.
+func (p *cephFSProvisioner) delete(volume *v1.PersistentVolume) error {
+	ann, ok := volume.Annotations[provisionerIDAnn]
 	if !ok {
 		return errors.New("identity annotation not found on PV")
 	}
 	if ann != string(p.identity) {
-		return &controller.IgnoredError{"identity annotation on PV does not match ours"}
+		return &controller.IgnoredError{Reason: "identity annotation on PV does not match ours"}
+	}
+
+	md, ok, err := p.store.GetPV(volume.Name)
+	if err != nil {
+		return fmt.Errorf("failed to look up metadata for PV %s: %v", volume.Name, err)
+	}
+	if !ok {
+		return fmt.Errorf("no metadata recorded for PV %s, cannot determine volume to delete", volume.Name)
+	}
+
+	if volume.Spec.PersistentVolumeSource.CephFS == nil {
+		return errors.New("PV has no CephFS volume source")
+	}
+	params := &cephFSParameters{
+		monitors: volume.Spec.PersistentVolumeSource.CephFS.Monitors,
+		adminID:  md.AdminID,
 	}
 
-	path := path.Join(p.pvDir, volume.Name)
-	if err := os.RemoveAll(path); err != nil {
+	// Authenticate as the same cluster admin identity Provision used, not
+	// the per-volume scoped cephx user created for mounting: the helper's
+	// --id and --key must belong to the same cephx entity, and only the
+	// admin entity is authorized to remove someone else's subvolume/user.
+	adminSecretObj, err := p.client.Core().Secrets(md.AdminSecretNamespace).Get(md.AdminSecretName)
+	if err != nil {
+		return fmt.Errorf("failed to get admin secret %s/%s: %v", md.AdminSecretNamespace, md.AdminSecretName, err)
+	}
+	adminSecret, ok := adminSecretObj.Data[secretKeyName]
+	if !ok {
+		return fmt.Errorf("admin secret %s/%s has no %q key", md.AdminSecretNamespace, md.AdminSecretName, secretKeyName)
+	}
+
+	if err := p.deleteVolume(md.CephUser, params, string(adminSecret)); err != nil {
 		return err
 	}
 
+	if err := p.client.Core().Secrets(md.SecretNamespace).Delete(md.SecretName, nil); err != nil {
+		glog.Errorf("failed to delete secret %s/%s: %v", md.SecretNamespace, md.SecretName, err)
+	}
+
+	if md.Gid != 0 {
+		if err := p.allocator.Release(md.GidNamespace, md.GidMin, md.GidMax, md.Gid); err != nil {
+			glog.Errorf("failed to release gid %d for PV %s: %v", md.Gid, volume.Name, err)
+		}
+	}
+
+	if err := p.store.DeletePV(volume.Name); err != nil {
+		glog.Errorf("failed to remove metadata for PV %s: %v", volume.Name, err)
+	}
+
 	return nil
 }
 
+var (
+	metadataConfigMapName      = flag.String("metadata-configmap-name", defaultMetadataConfigMapName, "Name of the ConfigMap used to persist the provisioner's identity and per-PV state.")
+	metadataConfigMapNamespace = flag.String("metadata-configmap-namespace", "", "Namespace of the metadata ConfigMap. Defaults to the POD_NAMESPACE the provisioner is running in.")
+
+	leaderElection              = flag.Bool("leader-election", false, "Enables leader election, allowing multiple provisioner replicas to run for HA without racing on the same PVC.")
+	leaderElectionNamespace     = flag.String("leader-election-namespace", "", "Namespace of the leader election lock. Defaults to the POD_NAMESPACE the provisioner is running in.")
+	leaderElectionLeaseDuration = flag.Duration("leader-election-lease-duration", 15*time.Second, "Duration that non-leader candidates will wait before forcing acquisition of the leader lease.")
+	leaderElectionRenewDeadline = flag.Duration("renew-deadline", 10*time.Second, "Duration the current leader will retry refreshing leadership before giving it up.")
+	leaderElectionRetryPeriod   = flag.Duration("retry-period", 2*time.Second, "Duration candidates should wait between actions in acquiring and renewing the leader lease.")
+
+	metricsAddress = flag.String("metrics-address", "", "Address (e.g. :8080) to serve Prometheus /metrics and /healthz on. Disabled if empty.")
+)
+
+// leaderElectionLockName derives the lock object name from provisionerName,
+// sanitized since provisionerName (e.g. "kubernetes.io/cephfs") isn't
+// itself a valid Kubernetes object name.
+func leaderElectionLockName() string {
+	return strings.Replace(provisionerName, "/", "-", -1)
+}
+
+// runLeaderElection runs run once this instance has acquired the leader
+// lease, and blocks until the lease is lost, at which point the process
+// exits so that a newly elected leader can safely take over.
+func runLeaderElection(clientset kubernetes.Interface, namespace string, run func(<-chan struct{})) {
+	id, err := os.Hostname()
+	if err != nil {
+		glog.Fatalf("Failed to determine hostname for leader election identity: %v", err)
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&v1.EventSinkImpl{Interface: clientset.Core().Events(namespace)})
+	recorder := broadcaster.NewRecorder(v1.EventSource{Component: leaderElectionLockName()})
+
+	lock, err := resourcelock.New(
+		resourcelock.ConfigMapsResourceLock,
+		namespace,
+		leaderElectionLockName(),
+		clientset.Core(),
+		resourcelock.ResourceLockConfig{
+			Identity:      id,
+			EventRecorder: recorder,
+		},
+	)
+	if err != nil {
+		glog.Fatalf("Failed to create leader election lock: %v", err)
+	}
+
+	leaderelection.RunOrDie(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: *leaderElectionLeaseDuration,
+		RenewDeadline: *leaderElectionRenewDeadline,
+		RetryPeriod:   *leaderElectionRetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: run,
+			OnStoppedLeading: func() {
+				glog.Fatalf("Lost leader lease, exiting")
+			},
+		},
+	})
+}
+
+// failureReason classifies err into one of the bounded-cardinality reasons
+// metrics.ProvisionFailuresTotal/DeleteFailuresTotal are labeled with. It's
+// necessarily a best-effort match on the error text produced above, since
+// cephFSProvisionerCLI's own errors aren't typed.
+func failureReason(err error) string {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "admin secret") || strings.Contains(msg, "identity annotation"):
+		return metrics.ReasonCephAuthFailure
+	case strings.Contains(msg, "quota"):
+		return metrics.ReasonQuotaFailure
+	case strings.Contains(msg, "mount cephfs root") || strings.Contains(msg, "mgr"):
+		return metrics.ReasonMgrUnreachable
+	case strings.Contains(msg, "timeout") || strings.Contains(msg, "deadline"):
+		return metrics.ReasonTimeout
+	case strings.Contains(msg, "invalid") || strings.Contains(msg, "missing"):
+		return metrics.ReasonInvalidParams
+	default:
+		return metrics.ReasonOther
+	}
+}
+
 func main() {
 	flag.Parse()
 	flag.Set("logtostderr", "true")
@@ -113,12 +704,43 @@ func main() {
 		glog.Fatalf("Error getting server version: %v", err)
 	}
 
+	metadataNamespace := *metadataConfigMapNamespace
+	if metadataNamespace == "" {
+		metadataNamespace = os.Getenv("POD_NAMESPACE")
+	}
+	if metadataNamespace == "" {
+		metadataNamespace = "default"
+	}
+	store := NewConfigMapMetadataStore(clientset, metadataNamespace, *metadataConfigMapName)
+
 	// Create the provisioner: it implements the Provisioner interface expected by
 	// the controller
-	cephFSProvisioner := NewCephFSProvisioner()
+	cephFSProvisioner, err := NewCephFSProvisioner(clientset, store, metadataNamespace)
+	if err != nil {
+		glog.Fatalf("Failed to create CephFS provisioner: %v", err)
+	}
+
+	if *metricsAddress != "" {
+		metrics.Register()
+		go metrics.Serve(*metricsAddress)
+	}
 
 	// Start the provision controller which will dynamically provision cephFS
 	// PVs
 	pc := controller.NewProvisionController(clientset, resyncPeriod, provisionerName, cephFSProvisioner, serverVersion.GitVersion, exponentialBackOffOnError, failedRetryThreshold)
-	pc.Run(wait.NeverStop)
+
+	if *leaderElection {
+		leaderElectionNs := *leaderElectionNamespace
+		if leaderElectionNs == "" {
+			leaderElectionNs = os.Getenv("POD_NAMESPACE")
+		}
+		if leaderElectionNs == "" {
+			leaderElectionNs = "default"
+		}
+		runLeaderElection(clientset, leaderElectionNs, func(stop <-chan struct{}) {
+			pc.Run(stop)
+		})
+	} else {
+		pc.Run(wait.NeverStop)
+	}
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kubernetes-incubator/external-storage/ceph/cephfs/pkg/metrics"
+)
+
+func TestParseParameters(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		wantErr    bool
+		check      func(t *testing.T, params *cephFSParameters)
+	}{
+		{
+			name: "valid minimal parameters get defaults",
+			parameters: map[string]string{
+				"monitors":        "10.0.0.1:6789,10.0.0.2:6789",
+				"adminSecretName": "ceph-admin-secret",
+			},
+			check: func(t *testing.T, params *cephFSParameters) {
+				if params.adminID != "admin" {
+					t.Errorf("adminID = %q, want %q", params.adminID, "admin")
+				}
+				if params.adminSecretNamespace != "default" {
+					t.Errorf("adminSecretNamespace = %q, want %q", params.adminSecretNamespace, "default")
+				}
+				if params.claimRoot != "/volumes" {
+					t.Errorf("claimRoot = %q, want %q", params.claimRoot, "/volumes")
+				}
+				if params.gidMin != defaultGidMin || params.gidMax != defaultGidMax {
+					t.Errorf("gid range = [%d, %d], want [%d, %d]", params.gidMin, params.gidMax, defaultGidMin, defaultGidMax)
+				}
+			},
+		},
+		{
+			name: "missing monitors is an error",
+			parameters: map[string]string{
+				"adminSecretName": "ceph-admin-secret",
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing adminSecretName is an error",
+			parameters: map[string]string{
+				"monitors": "10.0.0.1:6789",
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown parameter is an error",
+			parameters: map[string]string{
+				"monitors":        "10.0.0.1:6789",
+				"adminSecretName": "ceph-admin-secret",
+				"bogus":           "value",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid deterministicNames is an error",
+			parameters: map[string]string{
+				"monitors":           "10.0.0.1:6789",
+				"adminSecretName":    "ceph-admin-secret",
+				"deterministicNames": "not-a-bool",
+			},
+			wantErr: true,
+		},
+		{
+			name: "gidMin greater than gidMax with gidAllocate is an error",
+			parameters: map[string]string{
+				"monitors":        "10.0.0.1:6789",
+				"adminSecretName": "ceph-admin-secret",
+				"gidAllocate":     "true",
+				"gidMin":          "3000",
+				"gidMax":          "2000",
+			},
+			wantErr: true,
+		},
+		{
+			name: "gid range is parsed and honored",
+			parameters: map[string]string{
+				"monitors":        "10.0.0.1:6789",
+				"adminSecretName": "ceph-admin-secret",
+				"gidAllocate":     "true",
+				"gidMin":          "5000",
+				"gidMax":          "6000",
+			},
+			check: func(t *testing.T, params *cephFSParameters) {
+				if !params.gidAllocate {
+					t.Errorf("gidAllocate = false, want true")
+				}
+				if params.gidMin != 5000 || params.gidMax != 6000 {
+					t.Errorf("gid range = [%d, %d], want [5000, 6000]", params.gidMin, params.gidMax)
+				}
+			},
+		},
+	}
+
+	p := &cephFSProvisioner{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := p.parseParameters(tt.parameters)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseParameters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tt.check != nil {
+				tt.check(t, params)
+			}
+		})
+	}
+}
+
+func TestVolumeName(t *testing.T) {
+	if got := volumeName("pvc-1234", true); got != "pvc-1234" {
+		t.Errorf("volumeName(deterministic) = %q, want %q", got, "pvc-1234")
+	}
+
+	a := volumeName("pvc-1234", false)
+	b := volumeName("pvc-1234", false)
+	if a == b {
+		t.Errorf("volumeName(non-deterministic) returned the same name twice: %q", a)
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{errors.New("failed to get admin secret default/ceph-admin-secret: not found"), metrics.ReasonCephAuthFailure},
+		{errors.New("identity annotation not found on PV"), metrics.ReasonCephAuthFailure},
+		{errors.New("failed to set quota xattr on /mnt/vol: no such attribute"), metrics.ReasonQuotaFailure},
+		{errors.New("failed to mount cephfs root: connection refused"), metrics.ReasonMgrUnreachable},
+		{errors.New("context deadline exceeded"), metrics.ReasonTimeout},
+		{errors.New("invalid value \"x\" for parameter \"gidMin\""), metrics.ReasonInvalidParams},
+		{errors.New("something unexpected happened"), metrics.ReasonOther},
+	}
+
+	for _, tt := range tests {
+		if got := failureReason(tt.err); got != tt.want {
+			t.Errorf("failureReason(%q) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestLeaderElectionLockName(t *testing.T) {
+	if got, want := leaderElectionLockName(), "kubernetes.io-cephfs"; got != want {
+		t.Errorf("leaderElectionLockName() = %q, want %q", got, want)
+	}
+}
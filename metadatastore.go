@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/types"
+	"k8s.io/client-go/pkg/util/uuid"
+)
+
+// identityKey is the ConfigMap data key under which the provisioner's own
+// stable identity is stored.
+const identityKey = "identity"
+
+// pvMetadata is everything Delete needs to tear a volume down in Ceph,
+// recorded independently of whatever ends up on the PV object itself so
+// that Delete does not depend on PV annotations to find what to remove.
+// Delete still requires the PV's identity annotation to match this
+// provisioner before it uses the record.
+type pvMetadata struct {
+	SubvolumePath   string `json:"subvolumePath"`
+	CephUser        string `json:"cephUser"`
+	Pool            string `json:"pool"`
+	SecretName      string `json:"secretName"`
+	SecretNamespace string `json:"secretNamespace"`
+
+	// Admin identity used to create this volume, needed again in Delete to
+	// authenticate cephFSProvisionerCLI for teardown. This is deliberately
+	// kept separate from SecretName/SecretNamespace above, which identify
+	// the per-volume scoped cephx user's own secret and can't be used to
+	// authenticate as admin.
+	AdminID              string `json:"adminID"`
+	AdminSecretName      string `json:"adminSecretName"`
+	AdminSecretNamespace string `json:"adminSecretNamespace"`
+
+	// GID allocation bookkeeping, populated only when the StorageClass
+	// requested gidAllocate. GidNamespace/GidMin/GidMax identify which
+	// range pool the GID was taken from so Delete can return it.
+	Gid          int    `json:"gid,omitempty"`
+	GidNamespace string `json:"gidNamespace,omitempty"`
+	GidMin       int    `json:"gidMin,omitempty"`
+	GidMax       int    `json:"gidMax,omitempty"`
+}
+
+// MetadataStore persists the provisioner's identity and per-PV bookkeeping
+// across restarts, the way ceph-csi's k8s_configmap metadata store does.
+type MetadataStore interface {
+	// Identity returns the provisioner's stable identity, generating and
+	// persisting a new one the first time it is called.
+	Identity() (types.UID, error)
+	// SetPV records md for pvName, to be looked up again in Delete.
+	SetPV(pvName string, md *pvMetadata) error
+	// GetPV returns the record set by SetPV for pvName, or false if none
+	// exists.
+	GetPV(pvName string) (*pvMetadata, bool, error)
+	// DeletePV removes the record for pvName.
+	DeletePV(pvName string) error
+}
+
+// configMapMetadataStore implements MetadataStore on top of a single
+// Kubernetes ConfigMap, keying the provisioner identity under identityKey
+// and each PV's record under "pv-<pvName>".
+type configMapMetadataStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// NewConfigMapMetadataStore returns a MetadataStore backed by the ConfigMap
+// namespace/name, creating it on first use if it doesn't exist.
+func NewConfigMapMetadataStore(client kubernetes.Interface, namespace, name string) MetadataStore {
+	return &configMapMetadataStore{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+func pvDataKey(pvName string) string {
+	return "pv-" + pvName
+}
+
+func (s *configMapMetadataStore) getOrCreateConfigMap() (*v1.ConfigMap, error) {
+	cm, err := s.client.Core().ConfigMaps(s.namespace).Get(s.name)
+	if err == nil {
+		return cm, nil
+	}
+	if !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get metadata ConfigMap %s/%s: %v", s.namespace, s.name, err)
+	}
+
+	cm = &v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      s.name,
+			Namespace: s.namespace,
+		},
+		Data: map[string]string{},
+	}
+	cm, err = s.client.Core().ConfigMaps(s.namespace).Create(cm)
+	if err != nil && errors.IsAlreadyExists(err) {
+		return s.client.Core().ConfigMaps(s.namespace).Get(s.name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metadata ConfigMap %s/%s: %v", s.namespace, s.name, err)
+	}
+	return cm, nil
+}
+
+func (s *configMapMetadataStore) Identity() (types.UID, error) {
+	for {
+		cm, err := s.getOrCreateConfigMap()
+		if err != nil {
+			return "", err
+		}
+
+		if id, ok := cm.Data[identityKey]; ok && id != "" {
+			return types.UID(id), nil
+		}
+
+		id := uuid.NewUUID()
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[identityKey] = string(id)
+		if _, err := s.client.Core().ConfigMaps(s.namespace).Update(cm); err != nil {
+			if errors.IsConflict(err) {
+				continue
+			}
+			return "", fmt.Errorf("failed to persist provisioner identity to ConfigMap %s/%s: %v", s.namespace, s.name, err)
+		}
+		return id, nil
+	}
+}
+
+func (s *configMapMetadataStore) SetPV(pvName string, md *pvMetadata) error {
+	encoded, err := json.Marshal(md)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata for PV %s: %v", pvName, err)
+	}
+
+	for {
+		cm, err := s.getOrCreateConfigMap()
+		if err != nil {
+			return err
+		}
+
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[pvDataKey(pvName)] = string(encoded)
+		if _, err := s.client.Core().ConfigMaps(s.namespace).Update(cm); err != nil {
+			if errors.IsConflict(err) {
+				continue
+			}
+			return fmt.Errorf("failed to persist metadata for PV %s: %v", pvName, err)
+		}
+		return nil
+	}
+}
+
+func (s *configMapMetadataStore) GetPV(pvName string) (*pvMetadata, bool, error) {
+	cm, err := s.getOrCreateConfigMap()
+	if err != nil {
+		return nil, false, err
+	}
+
+	encoded, ok := cm.Data[pvDataKey(pvName)]
+	if !ok {
+		return nil, false, nil
+	}
+
+	md := &pvMetadata{}
+	if err := json.Unmarshal([]byte(encoded), md); err != nil {
+		return nil, false, fmt.Errorf("failed to decode metadata for PV %s: %v", pvName, err)
+	}
+	return md, true, nil
+}
+
+func (s *configMapMetadataStore) DeletePV(pvName string) error {
+	for {
+		cm, err := s.getOrCreateConfigMap()
+		if err != nil {
+			return err
+		}
+
+		if _, ok := cm.Data[pvDataKey(pvName)]; !ok {
+			return nil
+		}
+		delete(cm.Data, pvDataKey(pvName))
+		if _, err := s.client.Core().ConfigMaps(s.namespace).Update(cm); err != nil {
+			if errors.IsConflict(err) {
+				continue
+			}
+			return fmt.Errorf("failed to remove metadata for PV %s: %v", pvName, err)
+		}
+		return nil
+	}
+}
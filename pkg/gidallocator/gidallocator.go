@@ -0,0 +1,149 @@
+/*
+Package gidallocator hands out unique GIDs from a configured [min, max]
+range to provisioned volumes, the way aws-efs-provisioner's gidallocator
+does for EFS. A GID is recorded as "in use" as a key in the Data of a
+per-range ConfigMap (not in its annotations), so that replicas of the same
+provisioner racing on the same range never hand out the same GID twice.
+*/
+package gidallocator
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// configMapNamePrefix names the ConfigMap that tracks allocations for a
+// given range, so that multiple StorageClasses sharing a range (or a
+// range being reused after a rename) still coordinate correctly.
+const configMapNamePrefix = "gidallocator-"
+
+// Allocator hands out and releases GIDs from caller-specified ranges,
+// persisting the allocation state in a ConfigMap per range so that it
+// survives restarts and is safe across multiple provisioner replicas.
+type Allocator struct {
+	client kubernetes.Interface
+
+	// mutex serializes the read-modify-write ConfigMap update within this
+	// process; cross-replica safety comes from the ConfigMap's
+	// resourceVersion-checked Update call being retried on conflict.
+	mutex sync.Mutex
+}
+
+// New returns an Allocator backed by client.
+func New(client kubernetes.Interface) *Allocator {
+	return &Allocator{client: client}
+}
+
+func configMapName(namespace string, gidMin, gidMax int) string {
+	return fmt.Sprintf("%s%d-%d", configMapNamePrefix, gidMin, gidMax)
+}
+
+func gidKey(gid int) string {
+	return strconv.Itoa(gid)
+}
+
+// AllocateNext reserves and returns a free GID in [gidMin, gidMax], or an
+// error if the range is exhausted.
+func (a *Allocator) AllocateNext(namespace string, gidMin, gidMax int) (int, error) {
+	if gidMin <= 0 || gidMax <= 0 || gidMin > gidMax {
+		return 0, fmt.Errorf("invalid GID range [%d, %d]", gidMin, gidMax)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for {
+		cm, err := a.getOrCreateConfigMap(namespace, gidMin, gidMax)
+		if err != nil {
+			return 0, err
+		}
+
+		gid, err := firstFreeGID(cm.Data, gidMin, gidMax)
+		if err != nil {
+			return 0, err
+		}
+
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[gidKey(gid)] = "1"
+
+		if _, err := a.client.Core().ConfigMaps(namespace).Update(cm); err != nil {
+			if errors.IsConflict(err) {
+				continue
+			}
+			return 0, fmt.Errorf("failed to persist GID allocation: %v", err)
+		}
+
+		return gid, nil
+	}
+}
+
+// Release returns gid to the pool for reuse.
+func (a *Allocator) Release(namespace string, gidMin, gidMax, gid int) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for {
+		cm, err := a.getOrCreateConfigMap(namespace, gidMin, gidMax)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := cm.Data[gidKey(gid)]; !ok {
+			return nil
+		}
+		delete(cm.Data, gidKey(gid))
+
+		if _, err := a.client.Core().ConfigMaps(namespace).Update(cm); err != nil {
+			if errors.IsConflict(err) {
+				continue
+			}
+			return fmt.Errorf("failed to release GID %d: %v", gid, err)
+		}
+
+		return nil
+	}
+}
+
+func (a *Allocator) getOrCreateConfigMap(namespace string, gidMin, gidMax int) (*v1.ConfigMap, error) {
+	name := configMapName(namespace, gidMin, gidMax)
+
+	cm, err := a.client.Core().ConfigMaps(namespace).Get(name)
+	if err == nil {
+		return cm, nil
+	}
+	if !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get GID range ConfigMap %s/%s: %v", namespace, name, err)
+	}
+
+	cm = &v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Data: map[string]string{},
+	}
+	cm, err = a.client.Core().ConfigMaps(namespace).Create(cm)
+	if err != nil && errors.IsAlreadyExists(err) {
+		return a.client.Core().ConfigMaps(namespace).Get(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GID range ConfigMap %s/%s: %v", namespace, name, err)
+	}
+	return cm, nil
+}
+
+func firstFreeGID(used map[string]string, gidMin, gidMax int) (int, error) {
+	for gid := gidMin; gid <= gidMax; gid++ {
+		if _, ok := used[gidKey(gid)]; !ok {
+			return gid, nil
+		}
+	}
+	return 0, fmt.Errorf("no free GIDs in range [%d, %d]", gidMin, gidMax)
+}
@@ -0,0 +1,54 @@
+package gidallocator
+
+import "testing"
+
+func TestFirstFreeGID(t *testing.T) {
+	tests := []struct {
+		name    string
+		used    map[string]string
+		gidMin  int
+		gidMax  int
+		want    int
+		wantErr bool
+	}{
+		{
+			name:   "no allocations returns gidMin",
+			used:   map[string]string{},
+			gidMin: 2000,
+			gidMax: 2010,
+			want:   2000,
+		},
+		{
+			name:   "skips allocated GIDs",
+			used:   map[string]string{"2000": "1", "2001": "1"},
+			gidMin: 2000,
+			gidMax: 2010,
+			want:   2002,
+		},
+		{
+			name:    "exhausted range is an error",
+			used:    map[string]string{"2000": "1", "2001": "1"},
+			gidMin:  2000,
+			gidMax:  2001,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := firstFreeGID(tt.used, tt.gidMin, tt.gidMax)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("firstFreeGID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("firstFreeGID() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigMapName(t *testing.T) {
+	if got, want := configMapName("default", 2000, 2147483647), "gidallocator-2000-2147483647"; got != want {
+		t.Errorf("configMapName() = %q, want %q", got, want)
+	}
+}
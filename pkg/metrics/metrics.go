@@ -0,0 +1,124 @@
+// Package metrics registers and serves the Prometheus metrics that give
+// operational visibility into the provisioner's Provision/Delete calls,
+// which otherwise only show up as glog lines.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Failure reasons used to label the *_failures_total counters. Keeping
+// this as a closed set of constants (rather than free-form strings from
+// error messages) keeps cardinality bounded.
+const (
+	ReasonCephAuthFailure = "ceph-auth-failure"
+	ReasonQuotaFailure    = "quota-failure"
+	ReasonMgrUnreachable  = "mgr-unreachable"
+	ReasonTimeout         = "timeout"
+	ReasonInvalidParams   = "invalid-params"
+	ReasonOther           = "other"
+)
+
+const namespace = "cephfs_provisioner"
+
+var (
+	ProvisionAttemptsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "provision_attempts_total",
+		Help:      "Total number of Provision calls.",
+	})
+	ProvisionSuccessesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "provision_successes_total",
+		Help:      "Total number of successful Provision calls.",
+	})
+	ProvisionFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "provision_failures_total",
+		Help:      "Total number of failed Provision calls, broken out by reason.",
+	}, []string{"reason"})
+	ProvisionDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "provision_duration_seconds",
+		Help:      "End-to-end latency of Provision calls.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	DeleteAttemptsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "delete_attempts_total",
+		Help:      "Total number of Delete calls.",
+	})
+	DeleteSuccessesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "delete_successes_total",
+		Help:      "Total number of successful Delete calls.",
+	})
+	DeleteFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "delete_failures_total",
+		Help:      "Total number of failed Delete calls, broken out by reason.",
+	}, []string{"reason"})
+	DeleteDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "delete_duration_seconds",
+		Help:      "End-to-end latency of Delete calls.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	InFlightOperations = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "in_flight_operations",
+		Help:      "Number of Provision/Delete calls currently executing, a proxy for the controller's work queue depth.",
+	})
+
+	// QuotaEnforcementFailuresTotal counts subvolumes provisioned without
+	// their capacity actually being enforced (the setQuotaFallback xattr
+	// write failed). This is deliberately a separate counter rather than a
+	// ProvisionFailuresTotal reason: the Provision call itself still
+	// succeeds in this case, so counting it under ProvisionFailuresTotal
+	// would double-book the call against ProvisionSuccessesTotal too.
+	QuotaEnforcementFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "quota_enforcement_failures_total",
+		Help:      "Total number of subvolumes provisioned without their capacity being enforced.",
+	})
+)
+
+// Register adds all of this package's collectors to the default
+// Prometheus registry. It must be called once before Serve.
+func Register() {
+	prometheus.MustRegister(
+		ProvisionAttemptsTotal,
+		ProvisionSuccessesTotal,
+		ProvisionFailuresTotal,
+		ProvisionDurationSeconds,
+		DeleteAttemptsTotal,
+		DeleteSuccessesTotal,
+		DeleteFailuresTotal,
+		DeleteDurationSeconds,
+		InFlightOperations,
+		QuotaEnforcementFailuresTotal,
+	)
+}
+
+// Serve starts an HTTP server on address exposing /metrics for Prometheus
+// scraping and /healthz for liveness/readiness probes. It blocks and
+// should be run in its own goroutine.
+func Serve(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+
+	glog.Infof("Serving metrics on %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		glog.Errorf("metrics server exited: %v", err)
+	}
+}